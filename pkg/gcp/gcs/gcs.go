@@ -0,0 +1,360 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package gcs provides helpers for uploading and copying release artifacts
+// to Google Cloud Storage.
+package gcs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+)
+
+// ManifestFileName is the name of the manifest object written to the
+// destination prefix once an upload completes.
+const ManifestFileName = "upload-manifest.json"
+
+// defaultUploadWorkers is used when GCSUploadOptions.Workers is unset.
+const defaultUploadWorkers = 10
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ManifestEntry describes a single uploaded object.
+type ManifestEntry struct {
+	RelPath string `json:"relPath"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	CRC32C  uint32 `json:"crc32c"`
+}
+
+// Manifest is the set of entries uploaded for one release, written to
+// `<gcsDest>/upload-manifest.json` so re-runs are idempotent.
+type Manifest struct {
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// GCSUploadOptions configures the concurrent uploader.
+type GCSUploadOptions struct {
+	// Workers is the number of concurrent object uploads. Defaults to 10.
+	Workers int
+
+	// ResumeFromManifest skips objects whose CRC32C already matches an
+	// object of the same name already present in the destination.
+	ResumeFromManifest bool
+
+	// NoClobber refuses to overwrite existing objects. An existing object
+	// that ResumeFromManifest skips as unchanged is not an error.
+	NoClobber bool
+}
+
+// DefaultGCSUploadOptions are the options used when none are supplied.
+var DefaultGCSUploadOptions = &GCSUploadOptions{
+	Workers: defaultUploadWorkers,
+}
+
+// Uploader uploads a local directory tree to GCS using a worker pool, and
+// writes a content-addressed manifest alongside the uploaded objects.
+type Uploader struct {
+	client *storage.Client
+	opts   *GCSUploadOptions
+}
+
+// NewUploader creates an Uploader. If opts is nil, DefaultGCSUploadOptions
+// is used.
+func NewUploader(ctx context.Context, opts *GCSUploadOptions) (*Uploader, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "create GCS client")
+	}
+
+	if opts == nil {
+		opts = DefaultGCSUploadOptions
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = defaultUploadWorkers
+	}
+
+	return &Uploader{client: client, opts: opts}, nil
+}
+
+// Upload walks `srcPath` once, builds a manifest of its contents, uploads
+// every entry to `gs://<bucket>/<gcsDest>` using a pool of concurrent
+// workers, and finally writes the manifest itself to
+// `gs://<bucket>/<gcsDest>/upload-manifest.json`.
+func (u *Uploader) Upload(ctx context.Context, srcPath, bucket, gcsDest string) error {
+	manifest, err := buildManifest(srcPath)
+	if err != nil {
+		return errors.Wrap(err, "build upload manifest")
+	}
+
+	bkt := u.client.Bucket(bucket)
+
+	remoteCRC32C, err := u.existingCRC32C(ctx, bkt, gcsDest)
+	if err != nil {
+		return errors.Wrap(err, "fetch existing object attrs")
+	}
+
+	jobs := make(chan ManifestEntry)
+	errs := make(chan error)
+	var wg sync.WaitGroup
+
+	for i := 0; i < u.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				if err := u.uploadEntry(
+					ctx, bkt, srcPath, gcsDest, entry, remoteCRC32C,
+				); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	// Drain errs concurrently with the workers: if more failures occur than
+	// there are workers, writing to an unbuffered/bounded errs channel would
+	// otherwise block the workers (and in turn the send below) forever.
+	var firstErr error
+	errsDone := make(chan struct{})
+	go func() {
+		defer close(errsDone)
+		for err := range errs {
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}()
+
+	for _, entry := range manifest.Entries {
+		jobs <- entry
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+	<-errsDone
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return errors.Wrap(
+		u.writeManifest(ctx, bkt, gcsDest, manifest), "write upload manifest",
+	)
+}
+
+// uploadEntry uploads a single manifest entry, skipping it when
+// ResumeFromManifest is set and the remote object's CRC32C already matches.
+func (u *Uploader) uploadEntry(
+	ctx context.Context, bkt *storage.BucketHandle, srcPath, gcsDest string,
+	entry ManifestEntry, remoteCRC32C map[string]uint32,
+) error {
+	objectName := filepath.Join(gcsDest, entry.RelPath)
+
+	if u.opts.ResumeFromManifest {
+		if crc, ok := remoteCRC32C[objectName]; ok && crc == entry.CRC32C {
+			logrus.Infof("Skipping unchanged object %s", objectName)
+			return nil
+		}
+	}
+
+	obj := bkt.Object(objectName)
+	if u.opts.NoClobber {
+		if _, err := obj.Attrs(ctx); err == nil {
+			return errors.Errorf("object %s already exists", objectName)
+		} else if err != storage.ErrObjectNotExist {
+			return errors.Wrapf(err, "check existing object %s", objectName)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(srcPath, entry.RelPath))
+	if err != nil {
+		return errors.Wrapf(err, "open %s", entry.RelPath)
+	}
+	defer f.Close()
+
+	w := obj.NewWriter(ctx)
+	w.CRC32C = entry.CRC32C
+	w.SendCRC32C = true
+
+	logrus.Infof("Uploading %s", objectName)
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return errors.Wrapf(err, "upload %s", objectName)
+	}
+
+	return errors.Wrapf(w.Close(), "finalize upload of %s", objectName)
+}
+
+// existingCRC32C returns the CRC32C checksum of every object already present
+// under `gcsDest`, keyed by object name.
+func (u *Uploader) existingCRC32C(
+	ctx context.Context, bkt *storage.BucketHandle, gcsDest string,
+) (map[string]uint32, error) {
+	result := map[string]uint32{}
+	if !u.opts.ResumeFromManifest {
+		return result, nil
+	}
+
+	it := bkt.Objects(ctx, &storage.Query{Prefix: gcsDest})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "list existing objects")
+		}
+		result[attrs.Name] = attrs.CRC32C
+	}
+
+	return result, nil
+}
+
+// writeManifest uploads the manifest itself to
+// `gs://<bucket>/<gcsDest>/upload-manifest.json`.
+func (u *Uploader) writeManifest(
+	ctx context.Context, bkt *storage.BucketHandle, gcsDest string, manifest *Manifest,
+) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal manifest")
+	}
+
+	w := bkt.Object(filepath.Join(gcsDest, ManifestFileName)).NewWriter(ctx)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return errors.Wrap(err, "write manifest object")
+	}
+
+	return errors.Wrap(w.Close(), "finalize manifest upload")
+}
+
+// buildManifest walks srcPath and computes the SHA256 and CRC32C of every
+// regular file found.
+func buildManifest(srcPath string) (*Manifest, error) {
+	manifest := &Manifest{}
+
+	err := filepath.Walk(srcPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(srcPath, path)
+		if err != nil {
+			return errors.Wrapf(err, "compute relative path for %s", path)
+		}
+
+		sum, crc, err := hashFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "hash file %s", path)
+		}
+
+		manifest.Entries = append(manifest.Entries, ManifestEntry{
+			RelPath: relPath,
+			Size:    info.Size(),
+			SHA256:  sum,
+			CRC32C:  crc,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// hashFile returns the hex-encoded SHA256 and the CRC32C (Castagnoli) of the
+// file at path.
+func hashFile(path string) (sha256Hex string, crc32c uint32, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	c := crc32.New(crc32cTable)
+
+	if _, err := io.Copy(io.MultiWriter(h, c), f); err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), c.Sum32(), nil
+}
+
+// GCSCopyOptions configures the CopyToGCS helper. CopyToGCS runs the same
+// Uploader as Upload, so it also writes the upload manifest.
+type GCSCopyOptions struct {
+	// NoClobber refuses to overwrite existing objects.
+	NoClobber *bool
+}
+
+// DefaultGCSCopyOptions are the options used when none are supplied to
+// CopyToGCS.
+var DefaultGCSCopyOptions = GCSCopyOptions{}
+
+// CopyToGCS uploads the contents of srcPath to gs://<gcsPath> using the
+// concurrent, manifest-driven Uploader. It is kept as a thin, drop-in
+// compatible wrapper for callers that have not yet migrated to Uploader
+// directly.
+func CopyToGCS(srcPath, gcsPath string, opts GCSCopyOptions) error {
+	bucket, dest := splitGCSPath(gcsPath)
+
+	uploadOpts := *DefaultGCSUploadOptions
+	if opts.NoClobber != nil {
+		uploadOpts.NoClobber = *opts.NoClobber
+	}
+
+	ctx := context.Background()
+	uploader, err := NewUploader(ctx, &uploadOpts)
+	if err != nil {
+		return errors.Wrap(err, "create uploader")
+	}
+
+	return errors.Wrap(
+		uploader.Upload(ctx, srcPath, bucket, dest), "upload to GCS",
+	)
+}
+
+// splitGCSPath splits a `<bucket>/<dest...>` path, as historically produced
+// by filepath.Join(p.opts.Bucket, gcsPath), into its bucket and destination
+// components.
+func splitGCSPath(gcsPath string) (bucket, dest string) {
+	parts := strings.SplitN(gcsPath, string(filepath.Separator), 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
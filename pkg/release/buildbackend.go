@@ -0,0 +1,415 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package release
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// imagesSourcePath is the path, relative to the source tree, under which
+// each image's Dockerfile and build context live.
+const imagesSourcePath = "cluster/images"
+
+// kanikoJobTTLSeconds is how long a finished kaniko build Job is kept around
+// before the Kubernetes TTL controller garbage collects it.
+const kanikoJobTTLSeconds = int32(3600)
+
+// kanikoContextArchiveSuffix is appended to gcsDest to name the single
+// archive object gcs-fetcher downloads and extracts into the kaniko build
+// Job's workspace. gcs-fetcher's --object fetches and extracts one archive
+// object, not an arbitrary prefix of discrete objects, so the staged
+// release tree has to be packed into a single tarball first.
+const kanikoContextArchiveSuffix = ".tar.gz"
+
+// archiveAndUploadKanikoContext tars and gzips the staged release tree at
+// stageDir directly into a single object in bucket, named after gcsDest
+// with kanikoContextArchiveSuffix appended, for the gcs-fetcher init
+// container started by buildWithKaniko to fetch in one shot.
+func archiveAndUploadKanikoContext(ctx context.Context, bucket, stageDir, gcsDest string) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "create GCS client")
+	}
+
+	object := gcsDest + kanikoContextArchiveSuffix
+	w := client.Bucket(bucket).Object(object).NewWriter(ctx)
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+
+	walkErr := filepath.Walk(stageDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(stageDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if walkErr != nil {
+		return errors.Wrap(walkErr, "archive staged release tree")
+	}
+
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "close tar writer")
+	}
+	if err := gzw.Close(); err != nil {
+		return errors.Wrap(err, "close gzip writer")
+	}
+
+	return errors.Wrapf(w.Close(), "upload kaniko build context archive %s", object)
+}
+
+// BuildBackend selects how Images.Publish builds and pushes container
+// images.
+type BuildBackend string
+
+const (
+	// BuildBackendDocker pushes the per-arch image tarballs of the local
+	// build via Images.Publish, without contacting a docker daemon. This is
+	// the default and requires no further configuration.
+	BuildBackendDocker BuildBackend = "docker"
+
+	// BuildBackendKaniko builds and pushes each image via a Kubernetes Job
+	// running gcr.io/kaniko-project/executor, no local docker required.
+	BuildBackendKaniko BuildBackend = "kaniko"
+
+	// BuildBackendBuildah builds and pushes each image by shelling out to
+	// `buildah bud` and `buildah push`, for rootless CI environments.
+	BuildBackendBuildah BuildBackend = "buildah"
+)
+
+// KanikoConfig configures the Kubernetes Job submitted for each image when
+// BuildBackend is BuildBackendKaniko.
+type KanikoConfig struct {
+	// Namespace is the namespace the build Job is submitted to.
+	Namespace string
+
+	// ServiceAccount is the service account the build Job runs as.
+	ServiceAccount string
+
+	// CacheRepo is the registry repository kaniko uses for its layer cache.
+	CacheRepo string
+
+	// PVCName is the PersistentVolumeClaim mounted into the build Job that
+	// holds the staged release tarballs. If empty, the tarballs are instead
+	// downloaded from GCS via a gcs-fetcher init container.
+	PVCName string
+}
+
+// BuildResult reports the outcome of building and pushing a single image.
+type BuildResult struct {
+	Image string
+	Err   error
+}
+
+// BuildImages builds and pushes every image under buildDir for `version`
+// using the backend selected by `backend`, reporting each image's result on
+// the returned channel so callers can fail fast.
+func BuildImages(
+	backend BuildBackend, registry, version, buildDir, gcsBucket, gcsDest string,
+	kanikoCfg *KanikoConfig,
+) (<-chan BuildResult, error) {
+	images, err := existingImages(buildDir, version)
+	if err != nil {
+		return nil, errors.Wrap(err, "find images to build")
+	}
+
+	results := make(chan BuildResult, len(images))
+
+	go func() {
+		defer close(results)
+		for _, image := range images {
+			var err error
+			switch backend {
+			case BuildBackendKaniko:
+				err = buildWithKaniko(
+					image, registry, version, gcsBucket, gcsDest, kanikoCfg,
+				)
+			case BuildBackendBuildah:
+				err = buildWithBuildah(image, registry, version, buildDir)
+			default:
+				err = errors.Errorf("unsupported build backend %q", backend)
+			}
+			results <- BuildResult{Image: image, Err: err}
+		}
+	}()
+
+	return results, nil
+}
+
+// buildWithKaniko submits a Kubernetes Job that builds and pushes `image`
+// using gcr.io/kaniko-project/executor, mounting the staged release
+// tarballs from a PVC or, if none is configured, fetching them from GCS via
+// a gcs-fetcher init container.
+func buildWithKaniko(
+	image, registry, version, gcsBucket, gcsDest string, cfg *KanikoConfig,
+) error {
+	if cfg == nil {
+		return errors.New("KanikoConfig is required for the kaniko build backend")
+	}
+
+	clientset, err := kanikoClientset()
+	if err != nil {
+		return errors.Wrap(err, "create Kubernetes clientset")
+	}
+
+	job := kanikoJob(image, registry, version, gcsBucket, gcsDest, cfg)
+
+	logrus.Infof("Submitting kaniko build Job for image %s", image)
+	created, err := clientset.BatchV1().Jobs(cfg.Namespace).Create(
+		context.Background(), job, metav1.CreateOptions{},
+	)
+	if err != nil {
+		return errors.Wrapf(err, "create kaniko Job for image %s", image)
+	}
+
+	return errors.Wrapf(
+		waitForJobCompletion(clientset, cfg.Namespace, created.Name),
+		"wait for kaniko Job completion for image %s", image,
+	)
+}
+
+// kanikoJob builds the Kubernetes Job spec for a single image build.
+func kanikoJob(
+	image, registry, version, gcsBucket, gcsDest string, cfg *KanikoConfig,
+) *batchv1.Job {
+	jobName := fmt.Sprintf(
+		"kaniko-build-%s-%s", sanitizeJobName(image), sanitizeJobName(version),
+	)
+	destination := fmt.Sprintf("%s/%s:%s", registry, image, version)
+	tarsDir := "/workspace/release-tars"
+	// StageLocalArtifacts stages the release Dockerfiles under
+	// imagesSourcePath alongside the release tarballs when BuildBackendKaniko
+	// is selected, so they land in tarsDir with everything else.
+	dockerfile := fmt.Sprintf("%s/%s/%s/Dockerfile", tarsDir, imagesSourcePath, image)
+
+	initContainers := []corev1.Container{}
+	volumes := []corev1.Volume{}
+	volumeMounts := []corev1.VolumeMount{
+		{Name: "workspace", MountPath: "/workspace"},
+	}
+
+	if cfg.PVCName != "" {
+		volumes = append(volumes, corev1.Volume{
+			Name: "workspace",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: cfg.PVCName,
+				},
+			},
+		})
+	} else {
+		volumes = append(volumes, corev1.Volume{
+			Name:         "workspace",
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+		initContainers = append(initContainers, corev1.Container{
+			Name:  "fetch-release-tars",
+			Image: "gcr.io/cloud-builders/gcs-fetcher",
+			Args: []string{
+				fmt.Sprintf("--bucket=%s", gcsBucket),
+				fmt.Sprintf("--object=%s", gcsDest+kanikoContextArchiveSuffix),
+				fmt.Sprintf("--destination=%s", tarsDir),
+			},
+			VolumeMounts: volumeMounts,
+		})
+	}
+
+	container := corev1.Container{
+		Name:  "kaniko",
+		Image: "gcr.io/kaniko-project/executor:latest",
+		Args: []string{
+			fmt.Sprintf("--dockerfile=%s", dockerfile),
+			fmt.Sprintf("--context=dir://%s", tarsDir),
+			fmt.Sprintf("--destination=%s", destination),
+			fmt.Sprintf("--cache-repo=%s", cfg.CacheRepo),
+			"--cache=true",
+		},
+		VolumeMounts: volumeMounts,
+	}
+
+	backoffLimit := int32(1)
+	ttlSecondsAfterFinished := kanikoJobTTLSeconds
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName,
+			Namespace: cfg.Namespace,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: &ttlSecondsAfterFinished,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					ServiceAccountName: cfg.ServiceAccount,
+					RestartPolicy:      corev1.RestartPolicyNever,
+					InitContainers:     initContainers,
+					Containers:         []corev1.Container{container},
+					Volumes:            volumes,
+				},
+			},
+		},
+	}
+}
+
+// buildWithBuildah builds and pushes `image` by shelling out to `buildah
+// bud` and `buildah push`, for rootless CI environments without kaniko or
+// docker available.
+func buildWithBuildah(image, registry, version, buildDir string) error {
+	destination := fmt.Sprintf("%s/%s:%s", registry, image, version)
+	dockerfile := filepath.Join(buildDir, imagesSourcePath, image, "Dockerfile")
+
+	logrus.Infof("Building image %s with buildah", image)
+	budCmd := exec.Command(
+		"buildah", "bud", "-f", dockerfile, "-t", destination, buildDir,
+	)
+	if out, err := budCmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "buildah bud for %s: %s", image, out)
+	}
+
+	logrus.Infof("Pushing image %s with buildah", image)
+	pushCmd := exec.Command("buildah", "push", destination)
+	if out, err := pushCmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "buildah push for %s: %s", image, out)
+	}
+
+	return nil
+}
+
+// sanitizeJobName truncates and lower-cases s to fit the Kubernetes Job name
+// constraints.
+func sanitizeJobName(s string) string {
+	const maxLen = 40
+	s = strings.ToLower(s)
+	if len(s) > maxLen {
+		s = s[:maxLen]
+	}
+	return s
+}
+
+// kanikoClientset builds a Kubernetes clientset from the in-cluster config
+// when running as a Job/Pod, falling back to the default kubeconfig
+// resolution when run from a developer workstation.
+func kanikoClientset() (*kubernetes.Clientset, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			loadingRules, &clientcmd.ConfigOverrides{},
+		).ClientConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "resolve kubeconfig")
+		}
+	}
+
+	return kubernetes.NewForConfig(config)
+}
+
+// waitForJobCompletion blocks until the named Job reaches a terminal state,
+// returning an error if it failed. The apiserver may close the watch
+// connection before a long-running build finishes, so each time that
+// happens a fresh watch is started rather than giving up.
+func waitForJobCompletion(clientset *kubernetes.Clientset, namespace, name string) error {
+	for {
+		watcher, err := clientset.BatchV1().Jobs(namespace).Watch(
+			context.Background(), metav1.ListOptions{
+				FieldSelector: fmt.Sprintf("metadata.name=%s", name),
+			},
+		)
+		if err != nil {
+			return errors.Wrap(err, "watch kaniko Job")
+		}
+
+		done, succeeded := drainJobEvents(watcher.ResultChan())
+		watcher.Stop()
+
+		if done {
+			if succeeded {
+				return nil
+			}
+			return errors.Errorf("kaniko Job %s failed", name)
+		}
+		// Watch closed without a terminal state; re-establish it.
+	}
+}
+
+// drainJobEvents consumes a Job watch channel until it reports a terminal
+// state or the channel closes (e.g. on an apiserver watch timeout).
+func drainJobEvents(events <-chan watch.Event) (done, succeeded bool) {
+	for event := range events {
+		job, ok := event.Object.(*batchv1.Job)
+		if !ok {
+			continue
+		}
+
+		if job.Status.Succeeded > 0 {
+			return true, true
+		}
+		for _, cond := range job.Status.Conditions {
+			if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+				return true, false
+			}
+		}
+	}
+
+	return false, false
+}
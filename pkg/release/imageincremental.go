@@ -0,0 +1,267 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package release
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// latestMarkerName is the object the publisher writes alongside gcsDest to
+// record the most recently published version for a release channel.
+const latestMarkerName = "latest.txt"
+
+// incrementalPublish pushes the multi-arch index for `image` at `version`,
+// reusing any layer already present in the registry for the previous
+// release (as recorded by the `latest` marker file) instead of
+// re-uploading it. It mirrors images.publish(), but skips unchanged layers
+// per arch.
+func incrementalPublish(
+	registry, image, version, buildDir, previousVersion string, mediaType ImageMediaType,
+) error {
+	ref, err := name.ParseReference(
+		fmt.Sprintf("%s/%s:%s", registry, image, version),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "parse reference for image %s", image)
+	}
+
+	existingLayers, err := remoteLayerDigests(registry, image, previousVersion)
+	if err != nil {
+		logrus.Infof(
+			"No previous release found for %s, pushing all layers", image,
+		)
+		existingLayers = map[string]bool{}
+	}
+
+	idx := mutate.IndexMediaType(empty.Index, indexMediaType(mediaType))
+	var bytesSaved int64
+
+	for _, arch := range imageArchs {
+		tarPath := imageTarballPath(buildDir, image, version, arch)
+		img, err := tarball.ImageFromPath(tarPath, nil)
+		if err != nil {
+			logrus.Infof(
+				"No tarball for %s/%s, skipping: %v", image, arch, err,
+			)
+			continue
+		}
+		img = mutate.MediaType(img, manifestMediaType(mediaType))
+
+		layers, err := img.Layers()
+		if err != nil {
+			return errors.Wrapf(err, "get layers for image %s/%s", image, arch)
+		}
+
+		for _, layer := range layers {
+			digest, err := layer.Digest()
+			if err != nil {
+				return errors.Wrapf(
+					err, "get digest for image %s/%s", image, arch,
+				)
+			}
+
+			if existingLayers[digest.String()] {
+				size, err := layer.Size()
+				if err == nil {
+					bytesSaved += size
+				}
+				logrus.Infof(
+					"Reusing unchanged layer %s for image %s/%s",
+					digest, image, arch,
+				)
+				continue
+			}
+
+			if err := remote.WriteLayer(
+				ref.Context(), layer, remote.WithAuthFromKeychain(keychain()),
+			); err != nil {
+				return errors.Wrapf(
+					err, "push layer %s for image %s/%s", digest, image, arch,
+				)
+			}
+		}
+
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add: img,
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{
+					OS:           "linux",
+					Architecture: arch,
+				},
+			},
+		})
+	}
+
+	logrus.Infof(
+		"Incremental push for %s saved %d bytes of layer uploads",
+		image, bytesSaved,
+	)
+
+	return errors.Wrapf(
+		remote.WriteIndex(ref, idx, remote.WithAuthFromKeychain(keychain())),
+		"push image index for %s", image,
+	)
+}
+
+// remoteLayerDigests returns the set of layer digests (as addressed by the
+// registry, not their uncompressed DiffID) referenced by the previous
+// release of `image`, across every platform in its index. Any digest
+// collected here is trusted to already exist in the registry, since it was
+// pushed as part of that previous release; remote.WriteLayer independently
+// re-checks and skips any blob that's already present, so no separate
+// existence check is needed.
+func remoteLayerDigests(registry, image, previousVersion string) (map[string]bool, error) {
+	if previousVersion == "" {
+		return nil, errors.New("no previous version available")
+	}
+
+	ref, err := name.ParseReference(
+		fmt.Sprintf("%s/%s:%s", registry, image, previousVersion),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse reference for image %s", image)
+	}
+
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(keychain()))
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "fetch previous descriptor for %s", image,
+		)
+	}
+
+	images, err := previousPlatformImages(desc)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "resolve previous images for %s", image,
+		)
+	}
+
+	digests := map[string]bool{}
+	for _, img := range images {
+		layers, err := img.Layers()
+		if err != nil {
+			continue
+		}
+
+		for _, layer := range layers {
+			digest, err := layer.Digest()
+			if err != nil {
+				continue
+			}
+			digests[digest.String()] = true
+		}
+	}
+
+	return digests, nil
+}
+
+// previousPlatformImages resolves every per-platform image referenced by
+// desc, whether it points at a single image or a multi-arch index.
+func previousPlatformImages(desc *remote.Descriptor) ([]v1.Image, error) {
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		img, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		return []v1.Image{img}, nil
+	}
+
+	idxManifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]v1.Image, 0, len(idxManifest.Manifests))
+	for _, m := range idxManifest.Manifests {
+		img, err := idx.Image(m.Digest)
+		if err != nil {
+			continue
+		}
+		images = append(images, img)
+	}
+
+	return images, nil
+}
+
+// readLatestMarker returns the version recorded in the `latest.txt` marker
+// object written in the parent directory of gcsDest by a previous release, or
+// an error if none exists yet.
+func readLatestMarker(bucket, gcsDest string) (string, error) {
+	ctx := context.Background()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "create GCS client")
+	}
+
+	markerPath := filepath.Join(filepath.Dir(gcsDest), latestMarkerName)
+	r, err := client.Bucket(bucket).Object(markerPath).NewReader(ctx)
+	if err != nil {
+		return "", errors.Wrapf(err, "read latest marker %s", markerPath)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", errors.Wrap(err, "read latest marker contents")
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// publishIncremental publishes every image for `version`, reusing layers
+// from the previous release when IncrementalImagePush is enabled.
+func (i *Images) publishIncremental(
+	registry, version, buildDir, bucket, gcsDest string, mediaType ImageMediaType,
+) error {
+	previousVersion, err := readLatestMarker(bucket, gcsDest)
+	if err != nil {
+		logrus.Infof("Could not determine previous release version: %v", err)
+		previousVersion = ""
+	}
+
+	images, err := existingImages(buildDir, version)
+	if err != nil {
+		return errors.Wrap(err, "find images to publish")
+	}
+
+	for _, image := range images {
+		logrus.Infof("Incrementally publishing image %s", image)
+		if err := incrementalPublish(
+			registry, image, version, buildDir, previousVersion, mediaType,
+		); err != nil {
+			return errors.Wrapf(err, "incremental publish of %s", image)
+		}
+	}
+
+	return nil
+}
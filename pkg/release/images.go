@@ -0,0 +1,300 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package release
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/google"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ImageMediaType selects the manifest/media type family used when an image
+// index is assembled and pushed.
+type ImageMediaType string
+
+const (
+	// MediaTypeDocker pushes Docker v2s2 manifests and manifest lists.
+	MediaTypeDocker ImageMediaType = "docker"
+	// MediaTypeOCI pushes OCI image manifests and indexes.
+	MediaTypeOCI ImageMediaType = "oci"
+)
+
+// imageArchs are the architectures a release build produces per-arch
+// tarballs for.
+var imageArchs = []string{"amd64", "arm", "arm64", "ppc64le", "s390x"}
+
+// Images is responsible for publishing and validating container images that
+// are part of a release.
+type Images struct{}
+
+// NewImages can be used to create a new Images instance.
+func NewImages() *Images {
+	return &Images{}
+}
+
+// imageTarballPath returns the local path of the per-arch image tarball
+// produced by the release build for the given image and architecture.
+func imageTarballPath(buildDir, image, version, arch string) string {
+	return filepath.Join(
+		buildDir, ReleaseImagesPath, arch,
+		fmt.Sprintf("%s-%s.tar", image, version),
+	)
+}
+
+// keychain returns an authn.Keychain that resolves credentials from the
+// docker config and, for GCR, from Google credentials. It has no ECR- or
+// ACR-specific keychain; those registries authenticate only through entries
+// in the docker config.
+func keychain() authn.Keychain {
+	return authn.NewMultiKeychain(
+		authn.DefaultKeychain,
+		google.Keychain,
+	)
+}
+
+// Publish pushes the container images for the given version to the given
+// registry. For every image it loads the per-arch tarballs staged under
+// `buildDir` by the release build, assembles them into a single multi-arch
+// image index and pushes that index with `remote.WriteIndex`.
+func (i *Images) Publish(registry, version, buildDir string) error {
+	return i.publish(registry, version, buildDir, MediaTypeDocker)
+}
+
+// PublishWithMediaType behaves like Publish but allows the caller to select
+// the image media type used for the pushed manifests and index.
+func (i *Images) PublishWithMediaType(
+	registry, version, buildDir string, mediaType ImageMediaType,
+) error {
+	return i.publish(registry, version, buildDir, mediaType)
+}
+
+func (i *Images) publish(
+	registry, version, buildDir string, mediaType ImageMediaType,
+) error {
+	images, err := existingImages(buildDir, version)
+	if err != nil {
+		return errors.Wrap(err, "find images to publish")
+	}
+
+	for _, image := range images {
+		logrus.Infof("Publishing image %s", image)
+
+		idx := mutate.IndexMediaType(
+			empty.Index, indexMediaType(mediaType),
+		)
+
+		for _, arch := range imageArchs {
+			tarPath := imageTarballPath(buildDir, image, version, arch)
+			img, err := tarball.ImageFromPath(tarPath, nil)
+			if err != nil {
+				logrus.Infof(
+					"No tarball for %s/%s, skipping: %v", image, arch, err,
+				)
+				continue
+			}
+
+			img = mutate.MediaType(img, manifestMediaType(mediaType))
+
+			idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+				Add: img,
+				Descriptor: v1.Descriptor{
+					Platform: &v1.Platform{
+						OS:           "linux",
+						Architecture: arch,
+					},
+				},
+			})
+		}
+
+		ref, err := name.ParseReference(
+			fmt.Sprintf("%s/%s:%s", registry, image, version),
+		)
+		if err != nil {
+			return errors.Wrapf(err, "parse reference for image %s", image)
+		}
+
+		if err := remote.WriteIndex(
+			ref, idx, remote.WithAuthFromKeychain(keychain()),
+		); err != nil {
+			return errors.Wrapf(err, "push image index for %s", image)
+		}
+	}
+
+	return nil
+}
+
+// Validate fetches the digests of the images pushed to `registry` for
+// `version` and compares them against the digests of the local per-arch
+// tarballs staged under `buildDir`.
+func (i *Images) Validate(registry, version, buildDir string) error {
+	images, err := existingImages(buildDir, version)
+	if err != nil {
+		return errors.Wrap(err, "find images to validate")
+	}
+
+	for _, image := range images {
+		logrus.Infof("Validating image digests for %s", image)
+
+		for _, arch := range imageArchs {
+			tarPath := imageTarballPath(buildDir, image, version, arch)
+			localImage, err := tarball.ImageFromPath(tarPath, nil)
+			if err != nil {
+				continue
+			}
+			localDigest, err := localImage.Digest()
+			if err != nil {
+				return errors.Wrapf(
+					err, "get local digest for %s/%s", image, arch,
+				)
+			}
+
+			ref, err := name.ParseReference(fmt.Sprintf(
+				"%s/%s:%s", registry, image, version,
+			))
+			if err != nil {
+				return errors.Wrapf(
+					err, "parse reference for image %s", image,
+				)
+			}
+
+			desc, err := remote.Get(
+				ref, remote.WithAuthFromKeychain(keychain()),
+			)
+			if err != nil {
+				return errors.Wrapf(
+					err, "fetch remote descriptor for %s", image,
+				)
+			}
+
+			remoteImage, err := desc.Image()
+			if err != nil {
+				return errors.Wrapf(
+					err, "resolve remote image for %s", image,
+				)
+			}
+
+			remoteArchImage, err := imageForPlatform(remoteImage, desc, arch)
+			if err != nil {
+				return errors.Wrapf(
+					err, "find arch image for %s/%s", image, arch,
+				)
+			}
+
+			remoteDigest, err := remoteArchImage.Digest()
+			if err != nil {
+				return errors.Wrapf(
+					err, "get remote digest for %s/%s", image, arch,
+				)
+			}
+
+			if localDigest != remoteDigest {
+				return errors.Errorf(
+					"digest mismatch for %s/%s: local %s, remote %s",
+					image, arch, localDigest, remoteDigest,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// imageForPlatform resolves the per-arch image out of a remote descriptor,
+// which may point directly at an image or at an index.
+func imageForPlatform(
+	img v1.Image, desc *remote.Descriptor, arch string,
+) (v1.Image, error) {
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		// Not an index, assume a single-arch manifest already matches.
+		return img, nil
+	}
+
+	idxManifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range idxManifest.Manifests {
+		if m.Platform != nil && m.Platform.Architecture == arch {
+			return idx.Image(m.Digest)
+		}
+	}
+
+	return nil, errors.Errorf("no manifest found for arch %s", arch)
+}
+
+// existingImages walks the staged per-arch image tarballs under `buildDir`
+// for `version` and returns the distinct set of image names found. The
+// version is stripped from each tarball name exactly rather than guessed,
+// since release versions commonly contain hyphens themselves (e.g.
+// `v1.21.0-beta.1.15`).
+func existingImages(buildDir, version string) ([]string, error) {
+	imagesDir := filepath.Join(buildDir, ReleaseImagesPath)
+	suffix := "-" + version + ".tar"
+	seen := map[string]bool{}
+	names := []string{}
+
+	for _, arch := range imageArchs {
+		archDir := filepath.Join(imagesDir, arch)
+		entries, err := ioutil.ReadDir(archDir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), suffix) {
+				continue
+			}
+
+			name := strings.TrimSuffix(entry.Name(), suffix)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names, nil
+}
+
+func indexMediaType(m ImageMediaType) types.MediaType {
+	if m == MediaTypeOCI {
+		return types.OCIImageIndex
+	}
+	return types.DockerManifestList
+}
+
+func manifestMediaType(m ImageMediaType) types.MediaType {
+	if m == MediaTypeOCI {
+		return types.OCIManifestSchema1
+	}
+	return types.DockerManifestSchema2
+}
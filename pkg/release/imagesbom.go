@@ -0,0 +1,139 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package release
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/release/pkg/release/sbom"
+)
+
+// sbomArtifactType is the media type of the layer that holds the SPDX
+// document in each attached SBOM manifest. `crane`/`cosign` consumers find
+// those manifests via the OCI referrers API through their subject.
+const sbomArtifactType = "application/spdx+json"
+
+// GenerateAndAttachImageSBOM builds an SPDX SBOM for the published image
+// identified by `registry/image:version` and attaches it to the image using
+// the OCI referrers API, with `subject` pointing at the index digest that
+// Publish/PublishWithMediaType push the tag at, not at whichever per-arch
+// sub-image desc.Image() happens to resolve.
+func (i *Images) GenerateAndAttachImageSBOM(registry, image, version string) error {
+	ref, err := name.ParseReference(
+		fmt.Sprintf("%s/%s:%s", registry, image, version),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "parse reference for image %s", image)
+	}
+
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(keychain()))
+	if err != nil {
+		return errors.Wrapf(err, "fetch descriptor for image %s", image)
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return errors.Wrapf(err, "resolve image %s", image)
+	}
+
+	archImage, err := imageForPlatform(img, desc, imageArchs[0])
+	if err != nil {
+		return errors.Wrapf(err, "find arch image for %s/%s", image, imageArchs[0])
+	}
+
+	layerReaders, err := uncompressedLayerReaders(archImage)
+	if err != nil {
+		return errors.Wrapf(err, "open layers for image %s", image)
+	}
+
+	doc, err := sbom.GenerateForImage(image, layerReaders)
+	if err != nil {
+		return errors.Wrapf(err, "generate SBOM for image %s", image)
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return errors.Wrap(err, "marshal SBOM document")
+	}
+
+	digest := desc.Digest
+
+	sbomLayer := static.NewLayer(data, sbomArtifactType)
+	sbomImage, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer: sbomLayer,
+	})
+	if err != nil {
+		return errors.Wrap(err, "build SBOM artifact image")
+	}
+	sbomImage = mutate.MediaType(sbomImage, types.OCIManifestSchema1)
+	sbomImage, err = mutate.Subject(sbomImage, v1.Descriptor{Digest: digest})
+	if err != nil {
+		return errors.Wrap(err, "set SBOM subject descriptor")
+	}
+
+	sbomDigest, err := sbomImage.Digest()
+	if err != nil {
+		return errors.Wrap(err, "compute SBOM artifact digest")
+	}
+
+	logrus.Infof("Attaching SBOM to image %s@%s", image, digest)
+
+	return errors.Wrapf(
+		remote.Put(ref.Context().Digest(sbomDigest.String()), sbomImage,
+			remote.WithAuthFromKeychain(keychain())),
+		"attach SBOM to image %s", image,
+	)
+}
+
+// uncompressedLayerReaders returns a reader over the uncompressed contents
+// of every layer in img, bottom-to-top.
+func uncompressedLayerReaders(img v1.Image) ([]io.Reader, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	readers := make([]io.Reader, 0, len(layers))
+	for _, layer := range layers {
+		rc, err := layer.Uncompressed()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+
+		buf := &bytes.Buffer{}
+		if _, err := io.Copy(buf, rc); err != nil {
+			return nil, err
+		}
+		readers = append(readers, buf)
+	}
+
+	return readers, nil
+}
@@ -27,8 +27,8 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"k8s.io/release/pkg/gcp/gcs"
+	"k8s.io/release/pkg/release/sbom"
 	"k8s.io/release/pkg/util"
-	"k8s.io/utils/pointer"
 )
 
 // PushBuild is the main structure for pushing builds.
@@ -73,9 +73,53 @@ type PushBuildOptions struct {
 	// Specifies a fast build (linux amd64 only).
 	Fast bool
 
-	// Validate that the remove image digests exists, needs `skopeo` in
-	// `$PATH`.
+	// Validate that the remote image digests match the locally built images.
+	// Only meaningful when BuildBackend is BuildBackendDocker, since other
+	// backends build images in-cluster/remotely rather than from the local
+	// per-arch tarballs this compares against.
 	ValidateRemoteImageDigests bool
+
+	// ImageMediaType selects the manifest and index media type used when
+	// publishing container images (defaults to Docker v2s2 if unset).
+	ImageMediaType ImageMediaType
+
+	// SignArtifacts signs every uploaded GCS artifact and attaches an
+	// in-toto SLSA provenance attestation.
+	SignArtifacts bool
+
+	// SignImages signs every pushed image manifest and attaches an in-toto
+	// SLSA provenance attestation.
+	SignImages bool
+
+	// CosignKeyRef is the cosign key reference used for signing (supports
+	// `k8s://`, `gcpkms://` and file references). If empty, keyless
+	// OIDC-based signing is used.
+	CosignKeyRef string
+
+	// UploadWorkers is the number of concurrent GCS uploads to run. Defaults
+	// to the gcs package default if unset.
+	UploadWorkers int
+
+	// ResumeFromManifest skips uploading objects whose GCS CRC32C already
+	// matches the local copy, allowing a failed push to be re-run cheaply.
+	ResumeFromManifest bool
+
+	// IncrementalImagePush reuses layers already present in the registry
+	// from the previous release (as recorded by the `latest` marker file)
+	// instead of re-uploading them.
+	IncrementalImagePush bool
+
+	// GenerateSBOM produces SPDX SBOMs for every release tarball and
+	// container image.
+	GenerateSBOM bool
+
+	// BuildBackend selects how container images are built and pushed.
+	// Defaults to BuildBackendDocker.
+	BuildBackend BuildBackend
+
+	// KanikoConfig configures the in-cluster build Job used when
+	// BuildBackend is BuildBackendKaniko.
+	KanikoConfig *KanikoConfig
 }
 
 type stageFile struct {
@@ -207,19 +251,94 @@ func (p *PushBuild) Push() error {
 	if p.opts.DockerRegistry != "" {
 		images := NewImages()
 		normalizedVersion := strings.ReplaceAll(latest, "+", "_")
-		if err := images.Publish(
-			p.opts.DockerRegistry, normalizedVersion, p.opts.BuildDir,
+		mediaType := p.opts.ImageMediaType
+		if mediaType == "" {
+			mediaType = MediaTypeDocker
+		}
+
+		backend := p.opts.BuildBackend
+		if backend == "" {
+			backend = BuildBackendDocker
+		}
+
+		if backend == BuildBackendKaniko {
+			stageDir := filepath.Join(p.opts.BuildDir, GCSStagePath, latest)
+			logrus.Info("Archiving staged release tree for kaniko build context")
+			if err := archiveAndUploadKanikoContext(
+				context.Background(), p.opts.Bucket, stageDir, gcsDest,
+			); err != nil {
+				return errors.Wrap(err, "archive kaniko build context")
+			}
+		}
+
+		if backend != BuildBackendDocker {
+			results, err := BuildImages(
+				backend, p.opts.DockerRegistry, normalizedVersion,
+				p.opts.BuildDir, p.opts.Bucket, gcsDest, p.opts.KanikoConfig,
+			)
+			if err != nil {
+				return errors.Wrap(err, "build container images")
+			}
+			for result := range results {
+				if result.Err != nil {
+					return errors.Wrapf(
+						result.Err, "build image %s", result.Image,
+					)
+				}
+			}
+		} else if p.opts.IncrementalImagePush {
+			if err := images.publishIncremental(
+				p.opts.DockerRegistry, normalizedVersion, p.opts.BuildDir,
+				p.opts.Bucket, gcsDest, mediaType,
+			); err != nil {
+				return errors.Wrap(err, "incrementally publish container images")
+			}
+		} else if err := images.PublishWithMediaType(
+			p.opts.DockerRegistry, normalizedVersion, p.opts.BuildDir, mediaType,
 		); err != nil {
 			return errors.Wrap(err, "publish container images")
 		}
 
-		if p.opts.ValidateRemoteImageDigests {
+		if p.opts.ValidateRemoteImageDigests && backend != BuildBackendDocker {
+			logrus.Infof(
+				"Skipping remote image digest validation for build backend %q, "+
+					"images were not built from the local per-arch tarballs",
+				backend,
+			)
+		} else if p.opts.ValidateRemoteImageDigests {
 			if err := images.Validate(
 				p.opts.DockerRegistry, normalizedVersion, p.opts.BuildDir,
 			); err != nil {
 				return errors.Wrap(err, "validate container images")
 			}
 		}
+
+		signer := NewSigner(p.opts)
+		if err := signer.SignImages(
+			p.opts.DockerRegistry, normalizedVersion, p.opts.BuildDir,
+		); err != nil {
+			return errors.Wrap(err, "sign container images")
+		}
+
+		if p.opts.GenerateSBOM {
+			imageNames, err := existingImages(p.opts.BuildDir, normalizedVersion)
+			if err != nil {
+				return errors.Wrap(err, "find images to generate SBOMs for")
+			}
+			for _, imageName := range imageNames {
+				if err := images.GenerateAndAttachImageSBOM(
+					p.opts.DockerRegistry, imageName, normalizedVersion,
+				); err != nil {
+					return errors.Wrapf(err, "generate SBOM for image %s", imageName)
+				}
+			}
+		}
+	}
+
+	if err := NewSigner(p.opts).SignReleaseArtifacts(
+		p.opts.Bucket, gcsDest, p.opts.BuildDir,
+	); err != nil {
+		return errors.Wrap(err, "sign release artifacts")
 	}
 
 	if !p.opts.CI {
@@ -314,6 +433,27 @@ func (p *PushBuild) StageLocalArtifacts(version string) error {
 		return errors.Wrap(err, "copy source directory into destination")
 	}
 
+	if p.opts.GenerateSBOM {
+		logrus.Info("Generating tarball SBOMs")
+		if err := generateTarballSBOMs(stageDir); err != nil {
+			return errors.Wrap(err, "generate tarball SBOMs")
+		}
+	}
+
+	// The kaniko build Job fetches gcsDest (this stage dir, once uploaded)
+	// into its build context, so the per-image Dockerfiles need to be staged
+	// here too. buildah runs against the full local source tree directly and
+	// doesn't need this.
+	if p.opts.BuildBackend == BuildBackendKaniko {
+		logrus.Info("Staging image Dockerfiles for kaniko build")
+		if err := util.CopyDirContentsLocal(
+			filepath.Join(p.opts.BuildDir, imagesSourcePath),
+			filepath.Join(stageDir, imagesSourcePath),
+		); err != nil {
+			return errors.Wrap(err, "stage image Dockerfiles")
+		}
+	}
+
 	// Copy helpful GCP scripts to local GCS staging directory for push
 	logrus.Info("Copying GCP stage files")
 	if err := p.copyStageFiles(stageDir, gcpStageFiles); err != nil {
@@ -344,6 +484,24 @@ func (p *PushBuild) StageLocalArtifacts(version string) error {
 	return nil
 }
 
+// generateTarballSBOMs writes an SPDX SBOM alongside every tarball already
+// staged in stageDir, so PushReleaseArtifacts uploads them naturally.
+func generateTarballSBOMs(stageDir string) error {
+	tarballs, err := filepath.Glob(filepath.Join(stageDir, "*.tar.gz"))
+	if err != nil {
+		return errors.Wrap(err, "list staged tarballs")
+	}
+
+	for _, tarball := range tarballs {
+		logrus.Infof("Generating SBOM for %s", tarball)
+		if _, err := sbom.WriteTarballSBOM(tarball); err != nil {
+			return errors.Wrapf(err, "generate SBOM for %s", tarball)
+		}
+	}
+
+	return nil
+}
+
 // copyStageFiles takes the staging dir and copies each file of `files` into
 // it. It also ensures that the base dir exists before copying the file (if the
 // file is `required`).
@@ -377,10 +535,18 @@ func (p *PushBuild) copyStageFiles(stageDir string, files []stageFile) error {
 func (p *PushBuild) PushReleaseArtifacts(srcPath, gcsPath string) error {
 	logrus.Info("Pushing release artifacts")
 
-	copyOpts := gcs.DefaultGCSCopyOptions
-	copyOpts.NoClobber = pointer.BoolPtr(p.opts.AllowDup)
+	ctx := context.Background()
+	uploader, err := gcs.NewUploader(ctx, &gcs.GCSUploadOptions{
+		Workers:            p.opts.UploadWorkers,
+		ResumeFromManifest: p.opts.ResumeFromManifest,
+		NoClobber:          !p.opts.AllowDup,
+	})
+	if err != nil {
+		return errors.Wrap(err, "create GCS uploader")
+	}
 
-	return errors.Wrap(gcs.CopyToGCS(
-		srcPath, filepath.Join(p.opts.Bucket, gcsPath), copyOpts,
-	), "copy artifacts to GCS")
+	return errors.Wrap(
+		uploader.Upload(ctx, srcPath, p.opts.Bucket, gcsPath),
+		"upload artifacts to GCS",
+	)
 }
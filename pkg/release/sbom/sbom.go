@@ -0,0 +1,341 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sbom generates SPDX 2.3 JSON software bills of materials for
+// release tarballs and container images.
+package sbom
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SPDXVersion is the SPDX spec version every generated document declares.
+const SPDXVersion = "SPDX-2.3"
+
+// Document is the root of an SPDX 2.3 JSON document.
+type Document struct {
+	SPDXVersion       string    `json:"spdxVersion"`
+	DataLicense       string    `json:"dataLicense"`
+	SPDXID            string    `json:"SPDXID"`
+	Name              string    `json:"name"`
+	DocumentNamespace string    `json:"documentNamespace"`
+	CreationInfo      Creation  `json:"creationInfo"`
+	Packages          []Package `json:"packages"`
+	Files             []File    `json:"files,omitempty"`
+}
+
+// Creation records who/what produced the document and when.
+type Creation struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+// Package is an SPDX package entry, used for one per tarball or one per
+// distro package discovered inside an image layer.
+type Package struct {
+	SPDXID           string   `json:"SPDXID"`
+	Name             string   `json:"name"`
+	VersionInfo      string   `json:"versionInfo,omitempty"`
+	DownloadLocation string   `json:"downloadLocation"`
+	FilesAnalyzed    bool     `json:"filesAnalyzed"`
+	Checksums        []Sum    `json:"checksums,omitempty"`
+	LicenseConcluded string   `json:"licenseConcluded"`
+	HasFiles         []string `json:"hasFiles,omitempty"`
+}
+
+// File is an SPDX file entry for a single file inside a tarball.
+type File struct {
+	SPDXID      string `json:"SPDXID"`
+	FileName    string `json:"fileName"`
+	Checksums   []Sum  `json:"checksums"`
+	LicenseInfo string `json:"licenseConcluded"`
+}
+
+// Sum is a single SPDX checksum entry.
+type Sum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+// GenerateForTarball builds an SPDX document describing the contents of the
+// tarball at tarPath: one File entry per regular file in the archive plus a
+// single Package entry wrapping them all. Directories, links and other
+// non-regular members get no entry.
+func GenerateForTarball(tarPath string) (*Document, error) {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open tarball %s", tarPath)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(tarPath, ".gz") || strings.HasSuffix(tarPath, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open gzip reader for %s", tarPath)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	name := filepath.Base(tarPath)
+	pkgID := "SPDXRef-Package-" + sanitizeID(name)
+
+	doc := &Document{
+		SPDXVersion:       SPDXVersion,
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: "https://k8s.io/release/sbom/" + name,
+		CreationInfo: Creation{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: k8s.io/release/pkg/release/sbom"},
+		},
+	}
+
+	pkg := Package{
+		SPDXID:           pkgID,
+		Name:             name,
+		DownloadLocation: "NOASSERTION",
+		FilesAnalyzed:    true,
+		LicenseConcluded: "NOASSERTION",
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "read tar entry in %s", tarPath)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, errors.Wrapf(
+				err, "hash tar entry %s in %s", hdr.Name, tarPath,
+			)
+		}
+
+		fileID := "SPDXRef-File-" + sanitizeID(hdr.Name)
+		doc.Files = append(doc.Files, File{
+			SPDXID:   fileID,
+			FileName: hdr.Name,
+			Checksums: []Sum{{
+				Algorithm:     "SHA256",
+				ChecksumValue: hex.EncodeToString(h.Sum(nil)),
+			}},
+			LicenseInfo: "NOASSERTION",
+		})
+		pkg.HasFiles = append(pkg.HasFiles, fileID)
+	}
+
+	doc.Packages = []Package{pkg}
+
+	return doc, nil
+}
+
+// WriteTarballSBOM generates the SBOM for tarPath and writes it alongside
+// the tarball as `<tarball>.spdx.json`.
+func WriteTarballSBOM(tarPath string) (string, error) {
+	doc, err := GenerateForTarball(tarPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "generate SBOM for %s", tarPath)
+	}
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "marshal SBOM document")
+	}
+
+	dst := tarPath + ".spdx.json"
+	if err := ioutil.WriteFile(dst, data, 0o644); err != nil {
+		return "", errors.Wrapf(err, "write SBOM %s", dst)
+	}
+
+	return dst, nil
+}
+
+// sanitizeID replaces characters not permitted in an SPDX identifier with
+// dashes.
+func sanitizeID(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	return b.String()
+}
+
+// dpkgStatusPath and apkDBPath are the well-known locations of the package
+// manager databases inside dpkg- and apk-based image layers.
+const (
+	dpkgStatusPath = "var/lib/dpkg/status"
+	apkDBPath      = "lib/apk/db/installed"
+)
+
+// GenerateForImage builds an SPDX document for a container image given the
+// uncompressed tar contents of each of its layers, in bottom-to-top order.
+// It extracts installed package records from any dpkg or apk database found
+// in the layers.
+func GenerateForImage(imageName string, layers []io.Reader) (*Document, error) {
+	doc := &Document{
+		SPDXVersion:       SPDXVersion,
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              imageName,
+		DocumentNamespace: "https://k8s.io/release/sbom/" + sanitizeID(imageName),
+		CreationInfo: Creation{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: k8s.io/release/pkg/release/sbom"},
+		},
+	}
+
+	seen := map[string]bool{}
+
+	for _, layer := range layers {
+		tr := tar.NewReader(layer)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "read layer entry for %s", imageName)
+			}
+
+			name := strings.TrimPrefix(hdr.Name, "./")
+			var pkgs []Package
+			switch name {
+			case dpkgStatusPath:
+				pkgs, err = parseDpkgStatus(tr)
+			case apkDBPath:
+				pkgs, err = parseApkDB(tr)
+			default:
+				continue
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse package database %s", name)
+			}
+
+			for _, pkg := range pkgs {
+				if seen[pkg.SPDXID] {
+					continue
+				}
+				seen[pkg.SPDXID] = true
+				doc.Packages = append(doc.Packages, pkg)
+			}
+		}
+	}
+
+	return doc, nil
+}
+
+// parseDpkgStatus extracts installed package name/version pairs from a
+// Debian dpkg `status` database.
+func parseDpkgStatus(r io.Reader) ([]Package, error) {
+	pkgs := []Package{}
+	var name, version string
+
+	flush := func() {
+		if name != "" {
+			pkgs = append(pkgs, newDistroPackage(name, version))
+			name, version = "", ""
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "Package: "):
+			flush()
+			name = strings.TrimPrefix(line, "Package: ")
+		case strings.HasPrefix(line, "Version: "):
+			version = strings.TrimPrefix(line, "Version: ")
+		}
+	}
+	flush()
+
+	return pkgs, scanner.Err()
+}
+
+// parseApkDB extracts installed package name/version pairs from an Alpine
+// apk `installed` database.
+func parseApkDB(r io.Reader) ([]Package, error) {
+	pkgs := []Package{}
+	var name, version string
+
+	flush := func() {
+		if name != "" {
+			pkgs = append(pkgs, newDistroPackage(name, version))
+			name, version = "", ""
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "P:"):
+			flush()
+			name = strings.TrimPrefix(line, "P:")
+		case strings.HasPrefix(line, "V:"):
+			version = strings.TrimPrefix(line, "V:")
+		}
+	}
+	flush()
+
+	return pkgs, scanner.Err()
+}
+
+// newDistroPackage builds an SPDX Package entry for a distro package
+// manager record.
+func newDistroPackage(name, version string) Package {
+	return Package{
+		SPDXID:           "SPDXRef-Package-" + sanitizeID(name+"-"+version),
+		Name:             name,
+		VersionInfo:      version,
+		DownloadLocation: "NOASSERTION",
+		FilesAnalyzed:    false,
+		LicenseConcluded: "NOASSERTION",
+	}
+}
@@ -0,0 +1,416 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package release
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+)
+
+// signatureExtension and attestationExtension are appended to the name of a
+// GCS object to form the path of its detached signature and in-toto
+// attestation, following the cosign tag convention for registry artifacts.
+const (
+	signatureExtension   = ".sig"
+	attestationExtension = ".att"
+)
+
+// provenanceType is the in-toto predicate type passed to `cosign
+// attest`/`attest-blob` for the SLSA provenance attestations this package
+// produces.
+const provenanceType = "slsaprovenance"
+
+// Signer produces and verifies detached signatures and SLSA provenance
+// attestations for the artifacts and container images of a release, by
+// shelling out to the `cosign` CLI the same way buildWithBuildah shells out
+// to `buildah`.
+type Signer struct {
+	opts *PushBuildOptions
+}
+
+// NewSigner creates a new Signer for the given push options.
+func NewSigner(opts *PushBuildOptions) *Signer {
+	return &Signer{opts}
+}
+
+// provenance describes the in-toto SLSA provenance attestation attached to
+// every signed artifact and image.
+type provenance struct {
+	Builder    string   `json:"builder"`
+	SourceRepo string   `json:"sourceRepo"`
+	Commit     string   `json:"commit"`
+	Materials  []string `json:"materials"`
+}
+
+// buildProvenance assembles the SLSA provenance predicate for this build,
+// listing the release tarballs under ReleaseTarsPath as materials.
+func (s *Signer) buildProvenance(buildDir string) (*provenance, error) {
+	tarsDir := filepath.Join(buildDir, ReleaseTarsPath)
+	materials, err := filepath.Glob(filepath.Join(tarsDir, "*"))
+	if err != nil {
+		return nil, errors.Wrap(err, "list release tarballs")
+	}
+
+	commit, err := sourceCommit(buildDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve source commit")
+	}
+
+	return &provenance{
+		Builder:    "k8s.io/release PushBuild",
+		SourceRepo: "k8s.io/kubernetes",
+		Commit:     commit,
+		Materials:  materials,
+	}, nil
+}
+
+// sourceCommit returns the git commit SHA of the source tree the release
+// was built from.
+func sourceCommit(buildDir string) (string, error) {
+	cmd := exec.Command("git", "-C", buildDir, "rev-parse", "HEAD")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrap(err, "run git rev-parse")
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// writeProvenancePredicate writes prov to a temporary JSON file and returns
+// its path, for use as the `--predicate` argument to `cosign attest`/
+// `attest-blob`.
+func writeProvenancePredicate(prov *provenance) (string, error) {
+	data, err := json.Marshal(prov)
+	if err != nil {
+		return "", errors.Wrap(err, "marshal provenance predicate")
+	}
+
+	tmp, err := ioutil.TempFile("", "release-provenance-*.json")
+	if err != nil {
+		return "", errors.Wrap(err, "create temp file")
+	}
+	defer tmp.Close()
+
+	if _, err := tmp.Write(data); err != nil {
+		return "", errors.Wrap(err, "write provenance predicate")
+	}
+
+	return tmp.Name(), nil
+}
+
+// cosignArgs returns the flags selecting the configured signing identity: a
+// local/KMS/Kubernetes key reference, or cosign's keyless Fulcio/Rekor OIDC
+// flow (with confirmation prompts disabled) when CosignKeyRef is empty.
+func (s *Signer) cosignArgs() []string {
+	if s.opts.CosignKeyRef == "" {
+		return []string{"--yes"}
+	}
+	return []string{"--key", s.opts.CosignKeyRef}
+}
+
+// runCosign runs the cosign CLI with args, returning its combined output on
+// error for debuggability.
+func runCosign(ctx context.Context, args ...string) error {
+	out, err := exec.CommandContext(ctx, "cosign", args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "cosign %s: %s", strings.Join(args, " "), out)
+	}
+	return nil
+}
+
+// SignReleaseArtifacts signs every object already uploaded to
+// `gs://<bucket>/<gcsPath>` and uploads the resulting `<name>.sig` and
+// `<name>.att` objects alongside it.
+func (s *Signer) SignReleaseArtifacts(bucket, gcsPath, buildDir string) error {
+	if !s.opts.SignArtifacts {
+		return nil
+	}
+
+	logrus.Info("Signing release artifacts")
+
+	ctx := context.Background()
+
+	prov, err := s.buildProvenance(buildDir)
+	if err != nil {
+		return errors.Wrap(err, "build provenance attestation")
+	}
+
+	objects, err := s.listObjects(ctx, bucket, gcsPath)
+	if err != nil {
+		return errors.Wrap(err, "list uploaded artifacts")
+	}
+
+	for _, object := range objects {
+		if err := s.signAndAttestObject(ctx, prov, bucket, object); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// signAndAttestObject downloads gs://<bucket>/<object>, signs and attests
+// its real contents via the cosign CLI, and uploads the resulting signature
+// and attestation alongside it.
+func (s *Signer) signAndAttestObject(
+	ctx context.Context, prov *provenance, bucket, object string,
+) error {
+	localPath, err := s.downloadObject(ctx, bucket, object)
+	if err != nil {
+		return errors.Wrapf(err, "download artifact %s", object)
+	}
+	defer os.Remove(localPath)
+
+	sigPath := localPath + signatureExtension
+	signArgs := append([]string{
+		"sign-blob", "--output-signature", sigPath,
+	}, s.cosignArgs()...)
+	if err := runCosign(ctx, append(signArgs, localPath)...); err != nil {
+		return errors.Wrapf(err, "sign artifact %s", object)
+	}
+	defer os.Remove(sigPath)
+
+	sig, err := ioutil.ReadFile(sigPath)
+	if err != nil {
+		return errors.Wrapf(err, "read signature for %s", object)
+	}
+	if err := s.putObject(
+		ctx, bucket, object+signatureExtension, sig,
+	); err != nil {
+		return errors.Wrapf(err, "upload signature for %s", object)
+	}
+
+	predicatePath, err := writeProvenancePredicate(prov)
+	if err != nil {
+		return errors.Wrap(err, "write provenance predicate")
+	}
+	defer os.Remove(predicatePath)
+
+	attPath := localPath + attestationExtension
+	attestArgs := append([]string{
+		"attest-blob", "--predicate", predicatePath, "--type", provenanceType,
+		"--output-attestation", attPath,
+	}, s.cosignArgs()...)
+	if err := runCosign(ctx, append(attestArgs, localPath)...); err != nil {
+		return errors.Wrapf(err, "attest artifact %s", object)
+	}
+	defer os.Remove(attPath)
+
+	att, err := ioutil.ReadFile(attPath)
+	if err != nil {
+		return errors.Wrapf(err, "read attestation for %s", object)
+	}
+	if err := s.putObject(
+		ctx, bucket, object+attestationExtension, att,
+	); err != nil {
+		return errors.Wrapf(err, "upload attestation for %s", object)
+	}
+
+	return nil
+}
+
+// downloadObject fetches gs://<bucket>/<object> to a local temporary file
+// and returns its path, so the real artifact bytes (rather than the object
+// name) are what gets signed and attested.
+func (s *Signer) downloadObject(ctx context.Context, bucket, object string) (string, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "create GCS client")
+	}
+
+	r, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		return "", errors.Wrapf(err, "open object %s for reading", object)
+	}
+	defer r.Close()
+
+	tmp, err := ioutil.TempFile("", "release-sign-*")
+	if err != nil {
+		return "", errors.Wrap(err, "create temp file")
+	}
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return "", errors.Wrapf(err, "download object %s", object)
+	}
+
+	return tmp.Name(), nil
+}
+
+// listObjects returns the names of every object stored under `prefix` in
+// `bucket`.
+func (s *Signer) listObjects(ctx context.Context, bucket, prefix string) ([]string, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "create GCS client")
+	}
+
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	names := []string{}
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "iterate bucket objects")
+		}
+		names = append(names, attrs.Name)
+	}
+
+	return names, nil
+}
+
+// putObject writes `data` to `gs://<bucket>/<object>`.
+func (s *Signer) putObject(ctx context.Context, bucket, object string, data []byte) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "create GCS client")
+	}
+
+	w := client.Bucket(bucket).Object(object).NewWriter(ctx)
+	if _, err := w.Write(data); err != nil {
+		return errors.Wrapf(err, "write object %s", object)
+	}
+	return errors.Wrap(w.Close(), "close object writer")
+}
+
+// SignImages signs every image manifest published for `version` via `cosign
+// sign`/`cosign attest`.
+func (s *Signer) SignImages(registry, version, buildDir string) error {
+	if !s.opts.SignImages {
+		return nil
+	}
+
+	logrus.Info("Signing container images")
+
+	ctx := context.Background()
+
+	prov, err := s.buildProvenance(buildDir)
+	if err != nil {
+		return errors.Wrap(err, "build provenance attestation")
+	}
+
+	predicatePath, err := writeProvenancePredicate(prov)
+	if err != nil {
+		return errors.Wrap(err, "write provenance predicate")
+	}
+	defer os.Remove(predicatePath)
+
+	images, err := existingImages(buildDir, version)
+	if err != nil {
+		return errors.Wrap(err, "find images to sign")
+	}
+
+	for _, image := range images {
+		ref := fmt.Sprintf("%s/%s:%s", registry, image, version)
+
+		signArgs := append([]string{"sign"}, s.cosignArgs()...)
+		if err := runCosign(ctx, append(signArgs, ref)...); err != nil {
+			return errors.Wrapf(err, "sign image %s", image)
+		}
+
+		attestArgs := append([]string{
+			"attest", "--predicate", predicatePath, "--type", provenanceType,
+		}, s.cosignArgs()...)
+		if err := runCosign(ctx, append(attestArgs, ref)...); err != nil {
+			return errors.Wrapf(err, "attest image %s", image)
+		}
+	}
+
+	return nil
+}
+
+// VerifyReleaseSignatures verifies, via the cosign CLI, the detached
+// signatures and attestations of every artifact published under
+// `gs://<bucket>/.../<version>/...`.
+func VerifyReleaseSignatures(bucket, version string) error {
+	ctx := context.Background()
+	signer := &Signer{}
+
+	// The exact gcsDest prefix depends on flags (CI, GCSSuffix, Fast) that
+	// aren't available here, so scan the whole bucket and match on the
+	// version path segment actually used by Push() instead of guessing it.
+	objects, err := signer.listObjects(ctx, bucket, "")
+	if err != nil {
+		return errors.Wrap(err, "list release artifacts")
+	}
+
+	versionSegment := "/" + version + "/"
+	for _, object := range objects {
+		if !strings.Contains(object, versionSegment) {
+			continue
+		}
+		if strings.HasSuffix(object, signatureExtension) ||
+			strings.HasSuffix(object, attestationExtension) {
+			continue
+		}
+
+		if err := signer.verifyObject(ctx, bucket, object); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyObject downloads object and its detached signature and attestation
+// and verifies them via the cosign CLI.
+func (s *Signer) verifyObject(ctx context.Context, bucket, object string) error {
+	localPath, err := s.downloadObject(ctx, bucket, object)
+	if err != nil {
+		return errors.Wrapf(err, "download artifact %s", object)
+	}
+	defer os.Remove(localPath)
+
+	sigPath, err := s.downloadObject(ctx, bucket, object+signatureExtension)
+	if err != nil {
+		return errors.Wrapf(err, "download signature for %s", object)
+	}
+	defer os.Remove(sigPath)
+
+	if err := runCosign(
+		ctx, "verify-blob", "--signature", sigPath, localPath,
+	); err != nil {
+		return errors.Wrapf(err, "verify signature for %s", object)
+	}
+
+	attPath, err := s.downloadObject(ctx, bucket, object+attestationExtension)
+	if err != nil {
+		return errors.Wrapf(err, "download attestation for %s", object)
+	}
+	defer os.Remove(attPath)
+
+	if err := runCosign(
+		ctx, "verify-blob-attestation", "--signature", attPath, localPath,
+	); err != nil {
+		return errors.Wrapf(err, "verify attestation for %s", object)
+	}
+
+	return nil
+}